@@ -43,8 +43,9 @@ const MaxFileSize = int64(math.MaxInt32 - 1)
 
 // MaxMessageSize is the maximum amount of bytes that will be stored
 // in a protobuf message generated by bsdiff. This enable friendlier streaming apply
-// at a small storage cost
-// TODO: actually use
+// at a small storage cost: writeMessages splits any Add/Copy payload larger
+// than this across several Control messages, so an apply never has to hold
+// more than one message's worth of either in memory at a time.
 const MaxMessageSize int64 = 16 * 1024 * 1024
 
 // DiffContext holds settings for the diff process, along with some
@@ -84,16 +85,86 @@ type DiffStats struct {
 	BiggestAdd        int64
 }
 
-// WriteMessageFunc should write a given protobuf message and relay any errors
-// No reference to the given message can be kept, as its content may be modified
-// after WriteMessageFunc returns. See the `wire` package for an example implementation.
-type WriteMessageFunc func(msg proto.Message) (err error)
+// WriteMessageFunc should write a given protobuf message, relay any
+// errors, and report back the exact number of bytes written for msg,
+// including whatever framing the implementation adds around it (a length
+// prefix, typically) - callers like writeMessages rely on this being
+// exact, not approximate, to compute IndexEntry.MessageByteOffset for
+// later random access. No reference to the given message can be kept, as
+// its content may be modified after WriteMessageFunc returns. See the
+// `wire` package for an example implementation.
+//
+// BREAKING: this signature gained the n int64 return value (it used to
+// be just func(msg proto.Message) error) so writeMessages could compute
+// exact offsets instead of approximating them with a fixed overhead
+// constant. Every WriteMessageFunc implementation outside this package -
+// the `wire` package's included - needs updating to match before
+// upgrading past this change; it can't be made source-compatible with
+// the old signature.
+type WriteMessageFunc func(msg proto.Message) (n int64, err error)
 
 func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Match, writeMessage WriteMessageFunc) error {
 	var err error
 
-	bsdc := &Control{}
+	var index []IndexEntry
+	var messageByteOffset int64
+	var oldCursor, newCursor int64
+
+	// emit writes one logical Control message (an Add/Copy payload followed
+	// by a Seek), splitting the payload across as many physical messages as
+	// needed to keep each one under MaxMessageSize. Seek repositions the old
+	// file cursor for the *next* logical match, so it's only meaningful once
+	// this payload has been fully applied: it's carried by the last physical
+	// message, and every earlier one is a pure continuation with Seek: 0.
+	emit := func(seek int64, add []byte, copyBytes []byte) error {
+		for first := true; first || len(add) > 0 || len(copyBytes) > 0; first = false {
+			budget := MaxMessageSize
+
+			addPart := add
+			if int64(len(addPart)) > budget {
+				addPart = addPart[:budget]
+			}
+			budget -= int64(len(addPart))
+
+			copyPart := copyBytes
+			if int64(len(copyPart)) > budget {
+				copyPart = copyPart[:budget]
+			}
+
+			add = add[len(addPart):]
+			copyBytes = copyBytes[len(copyPart):]
+			isLast := len(add) == 0 && len(copyBytes) == 0
+
+			index = append(index, IndexEntry{
+				NewOffset:         newCursor,
+				OldOffset:         oldCursor,
+				MessageByteOffset: messageByteOffset,
+			})
+
+			msgSeek := int64(0)
+			if isLast {
+				msgSeek = seek
+			}
+
+			msg := &Control{Seek: msgSeek, Add: addPart, Copy: copyPart}
+			n, err := writeMessage(msg)
+			if err != nil {
+				return err
+			}
 
+			messageByteOffset += n
+			oldCursor += int64(len(addPart))
+			newCursor += int64(len(addPart)) + int64(len(copyPart))
+
+			if isLast {
+				oldCursor += seek
+			}
+		}
+
+		return nil
+	}
+
+	var add, copyBytes []byte
 	var prevMatch Match
 	first := true
 
@@ -101,10 +172,8 @@ func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Mat
 		if first {
 			first = false
 		} else {
-			bsdc.Seek = int64(match.addOldStart - (prevMatch.addOldStart + prevMatch.addLength))
-
-			err := writeMessage(bsdc)
-			if err != nil {
+			seek := int64(match.addOldStart - (prevMatch.addOldStart + prevMatch.addLength))
+			if err := emit(seek, add, copyBytes); err != nil {
 				return err
 			}
 		}
@@ -116,32 +185,84 @@ func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Mat
 			ctx.db.WriteByte(nbuf[match.addNewStart+i] - obuf[match.addOldStart+i])
 		}
 
-		bsdc.Add = ctx.db.Bytes()
-		bsdc.Copy = nbuf[match.copyStart():match.copyEnd]
+		add = ctx.db.Bytes()
+		copyBytes = nbuf[match.copyStart():match.copyEnd]
 
-		if ctx.Stats != nil && ctx.Stats.BiggestAdd < int64(len(bsdc.Add)) {
-			ctx.Stats.BiggestAdd = int64(len(bsdc.Add))
+		if ctx.Stats != nil && ctx.Stats.BiggestAdd < int64(len(add)) {
+			ctx.Stats.BiggestAdd = int64(len(add))
 		}
 
 		prevMatch = match
 	}
 
-	bsdc.Seek = 0
-	err = writeMessage(bsdc)
-	if err != nil {
+	if err := emit(0, add, copyBytes); err != nil {
 		return err
 	}
 
-	bsdc.Reset()
-	bsdc.Eof = true
-	err = writeMessage(bsdc)
+	eof := &Control{Eof: true}
+	n, err := writeMessage(eof)
 	if err != nil {
 		return err
 	}
+	messageByteOffset += n
+
+	if len(index) > 0 {
+		if err := writeIndex(writeMessage, index, messageByteOffset); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// writeIndex emits the Index entries (one IndexEntry per Control message
+// written by writeMessages, except the final Eof one) as one or more Index
+// frames, respecting
+// MaxMessageSize the same way emit splits Add/Copy payloads, followed by a
+// Trailer pointing back at the first one. All of these are ordinary
+// messages written after Eof, so an apply that stops reading once it sees
+// Eof never even notices them.
+func writeIndex(writeMessage WriteMessageFunc, index []IndexEntry, indexByteOffset int64) error {
+	var batch []*IndexEntry
+	var batchSize int64
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := writeMessage(&Index{Entries: batch}); err != nil {
+			return err
+		}
+		batch = nil
+		batchSize = 0
+		return nil
+	}
+
+	for i := range index {
+		entry := index[i]
+		entrySize := int64(proto.Size(&entry))
+
+		if len(batch) > 0 && batchSize+entrySize > MaxMessageSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, &entry)
+		batchSize += entrySize
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	_, err := writeMessage(&Trailer{
+		IndexByteOffset: indexByteOffset,
+		Magic:           TrailerMagic,
+	})
+	return err
+}
+
 // Do computes the difference between old and new, according to the bsdiff
 // algorithm, and writes the result to patch.
 func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, consumer *state.Consumer) error {
@@ -175,7 +296,7 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		// empty "new" file, only write EOF message
 		bsdc := &Control{}
 		bsdc.Eof = true
-		err := writeMessage(bsdc)
+		_, err := writeMessage(bsdc)
 		if err != nil {
 			return err
 		}
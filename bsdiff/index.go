@@ -0,0 +1,54 @@
+package bsdiff
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// TrailerMagic is written into every Trailer so a reader scanning backwards
+// from the end of a patch stream can tell a real trailer from a patch that
+// predates indexed streaming apply (and just happens to end on a plausible
+// message boundary).
+const TrailerMagic uint32 = 0x57484652 // "WHFR"
+
+// An IndexEntry records, for one emitted Control message, where it starts:
+// MessageByteOffset is its offset within the patch stream, while NewOffset
+// and OldOffset are the offsets (within the reconstructed new file, and
+// within the old file) that its Add/Copy payload starts contributing to.
+// A PatchReader uses this to find the messages that cover an arbitrary
+// range of the new file without replaying the patch from the start.
+type IndexEntry struct {
+	NewOffset         int64 `protobuf:"varint,1,opt,name=newOffset" json:"newOffset,omitempty"`
+	OldOffset         int64 `protobuf:"varint,2,opt,name=oldOffset" json:"oldOffset,omitempty"`
+	MessageByteOffset int64 `protobuf:"varint,3,opt,name=messageByteOffset" json:"messageByteOffset,omitempty"`
+}
+
+func (e *IndexEntry) Reset()         { *e = IndexEntry{} }
+func (e *IndexEntry) String() string { return proto.CompactTextString(e) }
+func (e *IndexEntry) ProtoMessage()  {}
+
+// An Index lists, across one or more consecutive Index messages written
+// after the Eof Control message, every Control message emitted during the
+// diff other than that Eof one, in order; it's split into several frames when there are enough
+// entries to exceed MaxMessageSize, the same way large Add/Copy payloads
+// are. It's ignored by any apply that just reads Control messages until
+// Eof, which is what keeps it backwards-compatible.
+type Index struct {
+	Entries []*IndexEntry `protobuf:"bytes,1,rep,name=entries" json:"entries,omitempty"`
+}
+
+func (i *Index) Reset()         { *i = Index{} }
+func (i *Index) String() string { return proto.CompactTextString(i) }
+func (i *Index) ProtoMessage()  {}
+
+// A Trailer is the last message in a patch stream. Its presence (guarded
+// by Magic) tells a reader that an Index immediately precedes it, starting
+// at IndexByteOffset, so the reader can seek straight there instead of
+// scanning the whole patch for it.
+type Trailer struct {
+	IndexByteOffset int64  `protobuf:"varint,1,opt,name=indexByteOffset" json:"indexByteOffset,omitempty"`
+	Magic           uint32 `protobuf:"varint,2,opt,name=magic" json:"magic,omitempty"`
+}
+
+func (t *Trailer) Reset()         { *t = Trailer{} }
+func (t *Trailer) String() string { return proto.CompactTextString(t) }
+func (t *Trailer) ProtoMessage()  {}
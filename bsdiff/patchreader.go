@@ -0,0 +1,217 @@
+package bsdiff
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ReadMessageFunc reads the next message from a patch stream starting at
+// byteOffset, and returns it along with the offset of the message that
+// follows it. It mirrors WriteMessageFunc, and is expected to come from
+// the same `wire` package used to write the stream.
+type ReadMessageFunc func(r io.ReaderAt, byteOffset int64, msg interface {
+	Reset()
+}) (nextByteOffset int64, err error)
+
+// trailerProbeWindow bounds how far back from the end of the stream
+// NewPatchReader will try candidate start offsets while looking for the
+// Trailer. The Trailer is the very last message, and tiny once encoded, so
+// this comfortably covers it plus framing overhead for any reasonable
+// WriteMessageFunc, without having to guess its exact encoded size (which
+// would otherwise risk landing mid-Index-message, since an Index can be
+// arbitrarily large).
+const trailerProbeWindow = 256
+
+// A PatchReader provides ReadAt-style, random access to the file
+// reconstructed by a patch, using the Index and Trailer written at the end
+// of the stream by DiffContext.writeMessages to seek directly to the
+// Control messages covering a given range, instead of replaying the whole
+// patch from the start.
+//
+// PatchReader only works against patches that carry an Index: older
+// patches, or ones produced before this was added, don't have a Trailer at
+// all, and neither does the Eof-only patch DiffContext.Do writes when the
+// new file is empty. NewPatchReader reports that via ErrNoIndex so callers
+// can fall back to a full, sequential apply.
+type PatchReader struct {
+	old         io.ReaderAt
+	patch       io.ReaderAt
+	patchSize   int64
+	readMessage ReadMessageFunc
+
+	index *Index
+}
+
+// ErrNoIndex is returned by NewPatchReader when the patch stream has no
+// Trailer: it predates indexed streaming apply, or it's the Eof-only patch
+// written for an empty new file.
+var ErrNoIndex = errors.New("bsdiff: patch has no index, can't do random access")
+
+// NewPatchReader reads the Trailer and Index off the end of patch (which
+// must support the full byte range from 0 to patchSize), so ReadAt calls
+// can later seek directly to the right Control messages. old is the
+// original file the patch was diffed against, needed to resolve Add
+// payloads.
+func NewPatchReader(old io.ReaderAt, patch io.ReaderAt, patchSize int64, readMessage ReadMessageFunc) (*PatchReader, error) {
+	trailerStart, trailer, err := findTrailer(patch, patchSize, readMessage)
+	if err != nil {
+		return nil, ErrNoIndex
+	}
+
+	var entries []*IndexEntry
+	byteOffset := trailer.IndexByteOffset
+	for byteOffset < trailerStart {
+		var part Index
+		next, err := readMessage(patch, byteOffset, &part)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading index")
+		}
+		entries = append(entries, part.Entries...)
+		byteOffset = next
+	}
+
+	return &PatchReader{
+		old:         old,
+		patch:       patch,
+		patchSize:   patchSize,
+		readMessage: readMessage,
+		index:       &Index{Entries: entries},
+	}, nil
+}
+
+// findTrailer locates the Trailer message by trying every candidate start
+// offset in the last trailerProbeWindow bytes of the stream, rather than
+// assuming it already knows where the Trailer begins: the message right
+// before it is an Index, whose encoded size grows with the number of
+// entries, so a fixed subtraction from patchSize can land mid-message. A
+// candidate is only accepted once it parses into a message that both ends
+// exactly at patchSize and carries TrailerMagic, which rules out decoding
+// garbage from a byte offset that merely happens to parse.
+func findTrailer(patch io.ReaderAt, patchSize int64, readMessage ReadMessageFunc) (int64, *Trailer, error) {
+	minStart := patchSize - trailerProbeWindow
+	if minStart < 0 {
+		minStart = 0
+	}
+
+	for start := patchSize - 1; start >= minStart; start-- {
+		var trailer Trailer
+		next, err := readMessage(patch, start, &trailer)
+		if err != nil {
+			continue
+		}
+		if next == patchSize && trailer.Magic == TrailerMagic {
+			return start, &trailer, nil
+		}
+	}
+
+	return 0, nil, errors.New("bsdiff: no trailer found")
+}
+
+// entryFor returns the last index entry whose NewOffset is at or before
+// newOffset: that's the Control message that starts contributing bytes to
+// the new file at or before the range we're after.
+func (pr *PatchReader) entryFor(newOffset int64) *IndexEntry {
+	var best *IndexEntry
+	for _, entry := range pr.index.Entries {
+		if entry.NewOffset > newOffset {
+			break
+		}
+		best = entry
+	}
+	return best
+}
+
+// ReadAt fills p with the bytes of the reconstructed new file starting at
+// newOffset, seeking directly to the Control messages that cover that
+// range rather than replaying the patch from the start.
+func (pr *PatchReader) ReadAt(p []byte, newOffset int64) (int, error) {
+	entry := pr.entryFor(newOffset)
+	if entry == nil {
+		return 0, errors.Errorf("bsdiff: no index entry covers new offset %d", newOffset)
+	}
+
+	cursor := entry.NewOffset
+	oldCursor := entry.OldOffset
+	byteOffset := entry.MessageByteOffset
+
+	n := 0
+	for n < len(p) {
+		var msg Control
+		next, err := pr.readMessage(pr.patch, byteOffset, &msg)
+		if err != nil {
+			return n, err
+		}
+		byteOffset = next
+
+		if msg.Eof {
+			return n, io.EOF
+		}
+
+		n, oldCursor, cursor, err = pr.applySegment(p, n, newOffset, cursor, oldCursor, msg.Add, true)
+		if err != nil {
+			return n, err
+		}
+
+		n, oldCursor, cursor, err = pr.applySegment(p, n, newOffset, cursor, oldCursor, msg.Copy, false)
+		if err != nil {
+			return n, err
+		}
+
+		oldCursor += msg.Seek
+	}
+
+	return n, nil
+}
+
+// applySegment copies the part of a single Add or Copy payload that falls
+// within [newOffset, newOffset+len(p)) into p, advancing oldCursor only
+// for Add payloads (isAdd), since Copy payloads carry literal new-file
+// bytes and don't consume old-file bytes.
+func (pr *PatchReader) applySegment(p []byte, n int, newOffset int64, cursor int64, oldCursor int64, payload []byte, isAdd bool) (int, int64, int64, error) {
+	segStart := cursor
+	segEnd := cursor + int64(len(payload))
+
+	lo := segStart
+	if lo < newOffset {
+		lo = newOffset
+	}
+	hi := segEnd
+	if hi > newOffset+int64(len(p)) {
+		hi = newOffset + int64(len(p))
+	}
+
+	if lo < hi {
+		var old []byte
+		if isAdd {
+			// one ReadAt for the whole overlapping range, instead of one
+			// per byte - old may be backed by a file or network source,
+			// where that's one round-trip instead of len(old) of them
+			old = make([]byte, hi-lo)
+			if _, err := pr.old.ReadAt(old, oldCursor+(lo-segStart)); err != nil {
+				return n, oldCursor, cursor, err
+			}
+		}
+
+		for pos := lo; pos < hi; pos++ {
+			dst := int(pos - newOffset)
+
+			out := payload[pos-segStart]
+			if isAdd {
+				out += old[pos-lo]
+			}
+
+			p[dst] = out
+			if dst+1 > n {
+				n = dst + 1
+			}
+		}
+	}
+
+	if isAdd {
+		oldCursor += int64(len(payload))
+	}
+	cursor = segEnd
+
+	return n, oldCursor, cursor, nil
+}
@@ -0,0 +1,134 @@
+package blockpool
+
+// A Chunker splits a byte stream into content-defined chunks: instead of
+// cutting every fixed number of bytes, it looks for a rolling-hash
+// fingerprint in the data itself, so that an insertion or deletion only
+// shifts the chunk boundaries immediately around the edit, rather than
+// every boundary downstream of it (the same property rollsum-based
+// chunking gives container image layers).
+//
+// Boundaries are entirely derived from the bytes that have been seen so
+// far, so the signature-producing side and a ValidatingSink fed the same
+// bytes always agree on where chunks start and end, without ever
+// exchanging offsets.
+type Chunker interface {
+	// Next looks for the end of the next chunk in buf. If atEOF is true,
+	// buf holds the last bytes of the stream, and Next must always return
+	// a boundary (even a short one, or the whole of buf) unless buf is
+	// empty, in which case it reports no boundary.
+	Next(buf []byte, atEOF bool) (length int, found bool)
+}
+
+const (
+	// MinChunkSize is the smallest chunk a rolling-hash Chunker will ever
+	// cut, short of running out of input at EOF.
+	MinChunkSize = 16 * 1024
+
+	// AvgChunkSize is the average spacing, for data with no particular
+	// structure, between positions where the rolling hash matches
+	// chunkMask.
+	AvgChunkSize = 64 * 1024
+
+	// MaxChunkSize is the largest chunk a rolling-hash Chunker will ever
+	// cut: if no boundary has been found by then, it cuts anyway, so
+	// chunk size stays bounded even on pathological input.
+	MaxChunkSize = 256 * 1024
+)
+
+// winSize is the width, in bytes, of the rolling hash's window. It's wide
+// enough to give insertions/deletions a good chance of being isolated to a
+// single chunk, narrow enough that updating the hash by one byte stays
+// O(1).
+const winSize = 64
+
+// chunkMask is ANDed with the rolling hash to decide where to cut. It's
+// derived from AvgChunkSize so that, on random data, the hash matches it on
+// average once every AvgChunkSize bytes. Matches within the first
+// MinChunkSize bytes of a chunk are ignored and chunks are capped at
+// MaxChunkSize, so on such data chunks average roughly 80 KiB.
+const chunkMask = uint32(AvgChunkSize - 1)
+
+// rollingHashChunker implements Chunker with a buzhash-style rolling hash:
+// a table of pseudo-random 32-bit words, one per input byte value, XORed
+// together (with a rotation that depends on position in the window) so
+// the whole window's contribution can be updated in constant time as
+// bytes enter and leave it.
+type rollingHashChunker struct {
+	table [256]uint32
+}
+
+// NewRollingHashChunker returns a Chunker backed by a buzhash rolling
+// hash. Two chunkers created this way always produce the same table, and
+// therefore the same cuts for the same bytes, which is what lets the
+// diff side and the validating side agree without ever transmitting
+// boundary offsets.
+func NewRollingHashChunker() Chunker {
+	c := &rollingHashChunker{}
+	for i := range c.table {
+		c.table[i] = buzhashTableEntry(byte(i))
+	}
+	return c
+}
+
+func rotl32(x uint32, n uint) uint32 {
+	n &= 31
+	return (x << n) | (x >> (32 - n))
+}
+
+// Next implements Chunker.
+func (c *rollingHashChunker) Next(buf []byte, atEOF bool) (int, bool) {
+	if len(buf) == 0 {
+		return 0, false
+	}
+
+	limit := MaxChunkSize
+	if limit > len(buf) {
+		limit = len(buf)
+	}
+
+	if limit < MinChunkSize && !atEOF {
+		// not enough buffered data to make a decision yet
+		return 0, false
+	}
+
+	var h uint32
+	for i := 0; i < limit; i++ {
+		h = rotl32(h, 1) ^ c.table[buf[i]]
+
+		if i >= winSize {
+			h ^= rotl32(c.table[buf[i-winSize]], uint(winSize))
+		}
+
+		if i+1 >= MinChunkSize && h&chunkMask == chunkMask {
+			return i + 1, true
+		}
+	}
+
+	if atEOF {
+		// end of stream: whatever's left, hash or no hash, is the last chunk
+		return limit, true
+	}
+
+	if limit == MaxChunkSize {
+		// MaxChunkSize bytes are buffered and the hash still never fired:
+		// cut deterministically so boundaries stay reproducible from the
+		// byte stream alone, and chunk size stays bounded
+		return limit, true
+	}
+
+	// not at EOF, and fewer than MaxChunkSize bytes buffered: wait for more
+	// rather than cutting a short chunk early
+	return 0, false
+}
+
+// buzhashTableEntry derives the table entry for input byte b from a fixed
+// seed, so every Chunker - in every process, on every machine - computes
+// the exact same table without needing to ship it anywhere.
+func buzhashTableEntry(b byte) uint32 {
+	h := uint32(2166136261) // FNV-1a offset basis
+	h = (h ^ uint32(b)) * 16777619
+	h ^= h >> 15
+	h *= 2246822519
+	h ^= h >> 13
+	return h
+}
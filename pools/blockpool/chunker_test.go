@@ -0,0 +1,91 @@
+package blockpool
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRollingHashChunkerMinChunkSize(t *testing.T) {
+	c := NewRollingHashChunker()
+
+	// less than MinChunkSize buffered, not at EOF: must wait for more data
+	length, found := c.Next(make([]byte, MinChunkSize-1), false)
+	if found {
+		t.Fatalf("expected no boundary below MinChunkSize, got length=%d", length)
+	}
+}
+
+func TestRollingHashChunkerMaxChunkSizeFallback(t *testing.T) {
+	c := NewRollingHashChunker()
+
+	// data that never hits the hash condition within MaxChunkSize: over a
+	// full window of identical zero bytes the rotated table entries cancel
+	// out and the hash stays 0, so it can't match the mask, and we only
+	// need the cut to be deterministic, not the content to be "real" data
+	buf := make([]byte, MaxChunkSize)
+
+	length, found := c.Next(buf, false)
+	if !found || length != MaxChunkSize {
+		t.Fatalf("expected a deterministic cut at MaxChunkSize, got length=%d found=%v", length, found)
+	}
+}
+
+func TestRollingHashChunkerWaitsBelowMaxChunkSize(t *testing.T) {
+	c := NewRollingHashChunker()
+
+	// more than MinChunkSize, less than MaxChunkSize, not at EOF: the
+	// fallback cut must not fire early just because some data is buffered
+	buf := make([]byte, MaxChunkSize-1)
+	length, found := c.Next(buf, false)
+	if found {
+		t.Fatalf("expected no boundary before MaxChunkSize bytes are buffered, got length=%d", length)
+	}
+}
+
+func TestRollingHashChunkerEOFAlwaysCuts(t *testing.T) {
+	c := NewRollingHashChunker()
+
+	for _, size := range []int{0, 1, MinChunkSize - 1, MinChunkSize, MaxChunkSize - 1} {
+		buf := make([]byte, size)
+		length, found := c.Next(buf, true)
+		if size == 0 {
+			if found {
+				t.Fatalf("expected no boundary for an empty buffer, even at EOF")
+			}
+			continue
+		}
+		// the rolling hash may legitimately fire before the buffer ends;
+		// all that's guaranteed at EOF is that a boundary is found, and
+		// that it never reaches past what's actually buffered
+		if !found || length <= 0 || length > size {
+			t.Fatalf("at EOF with %d buffered bytes, expected a boundary within it, got length=%d found=%v", size, length, found)
+		}
+	}
+}
+
+func TestRollingHashChunkerDeterministic(t *testing.T) {
+	buf := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog"), 20000)
+
+	var cutsA, cutsB []int
+	for _, cuts := range []*[]int{&cutsA, &cutsB} {
+		c := NewRollingHashChunker()
+		offset := 0
+		for offset < len(buf) {
+			length, found := c.Next(buf[offset:], offset+MaxChunkSize >= len(buf))
+			if !found {
+				t.Fatalf("expected a boundary")
+			}
+			offset += length
+			*cuts = append(*cuts, offset)
+		}
+	}
+
+	if len(cutsA) != len(cutsB) {
+		t.Fatalf("two chunkers over the same bytes produced different cut counts: %d vs %d", len(cutsA), len(cutsB))
+	}
+	for i := range cutsA {
+		if cutsA[i] != cutsB[i] {
+			t.Fatalf("cut %d differs: %d vs %d", i, cutsA[i], cutsB[i])
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package blockpool
+
+import (
+	"io"
+
+	"github.com/itchio/wharf/sync"
+)
+
+// ComputeChunkHashes runs chunker over r the same way storeChunked later
+// will, so the cuts - and therefore each ChunkHash's Offset and Length -
+// are exactly the ones a ValidatingSink or HealingSink fed the same bytes
+// is guaranteed to reproduce. It's the signature-producing half of
+// content-defined chunking: call it once per file, in container order,
+// to build the map NewChunkedSignatureInfo expects.
+//
+// An empty file still yields a single zero-length ChunkHash, for parity
+// with the fixed-block scheme's empty-file shortblock.
+func ComputeChunkHashes(r io.Reader, chunker Chunker) ([]ChunkHash, error) {
+	var sctx sync.Context
+	var hashes []ChunkHash
+	var buf []byte
+	var offset int64
+	sawEOF := false
+
+	rdbuf := make([]byte, MaxChunkSize)
+	for !sawEOF {
+		n, err := r.Read(rdbuf)
+		if n > 0 {
+			buf = append(buf, rdbuf[:n]...)
+		}
+		if err == io.EOF {
+			sawEOF = true
+		} else if err != nil {
+			return nil, err
+		}
+
+		for {
+			length, found := chunker.Next(buf, sawEOF)
+			if !found {
+				break
+			}
+
+			chunk := buf[:length]
+			weakHash, strongHash := sctx.HashBlock(chunk)
+			hashes = append(hashes, ChunkHash{
+				Offset:     offset,
+				Length:     int64(length),
+				WeakHash:   weakHash,
+				StrongHash: strongHash,
+			})
+
+			offset += int64(length)
+			buf = buf[length:]
+		}
+	}
+
+	if len(hashes) == 0 {
+		weakHash, strongHash := sctx.HashBlock(nil)
+		hashes = append(hashes, ChunkHash{WeakHash: weakHash, StrongHash: strongHash})
+	}
+
+	return hashes, nil
+}
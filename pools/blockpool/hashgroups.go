@@ -0,0 +1,106 @@
+package blockpool
+
+import (
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/sync"
+	"github.com/itchio/wharf/tlc"
+)
+
+// computeHashGroups groups Signature's small-block hashes by the big-block
+// BlockLocation they belong to, so a Store call (which receives one big
+// block at a time) can look up just the hashes relevant to it. It's shared
+// by ValidatingSink and HealingSink, which both need the exact same
+// grouping to drive their respective Store implementations.
+func computeHashGroups(container *tlc.Container, signature *SignatureInfo) (map[BlockLocation][]sync.BlockHash, error) {
+	smallBlockSize := int64(pwr.BlockSize)
+
+	pathToFileIndex := make(map[string]int64)
+	for fileIndex, f := range container.Files {
+		pathToFileIndex[f.Path] = int64(fileIndex)
+	}
+
+	hashGroups := make(map[BlockLocation][]sync.BlockHash)
+	hashIndex := int64(0)
+
+	for _, f := range signature.container.Files {
+		fileIndex := pathToFileIndex[f.Path]
+
+		if f.Size == 0 {
+			// empty files have a 0-length shortblock for historical reasons.
+			hashIndex++
+			continue
+		}
+
+		numBigBlocks := ComputeNumBlocks(f.Size)
+		for blockIndex := int64(0); blockIndex < numBigBlocks; blockIndex++ {
+			loc := BlockLocation{
+				FileIndex:  fileIndex,
+				BlockIndex: blockIndex,
+			}
+
+			blockSize := ComputeBlockSize(f.Size, blockIndex)
+			numSmallBlocks := (blockSize + smallBlockSize - 1) / smallBlockSize
+
+			hashGroups[loc] = signature.hashes[hashIndex : hashIndex+numSmallBlocks]
+			hashIndex += numSmallBlocks
+		}
+	}
+
+	return hashGroups, nil
+}
+
+// bigBlockOffset returns the byte offset, within a file of the given size,
+// of the big block identified by blockIndex. Big blocks aren't necessarily
+// uniform in size (ComputeBlockSize returns a shorter final block), so this
+// sums every preceding block's actual size rather than assuming
+// blockIndex*pwr.BlockSize.
+func bigBlockOffset(fileSize int64, blockIndex int64) int64 {
+	var offset int64
+	for i := int64(0); i < blockIndex; i++ {
+		offset += ComputeBlockSize(fileSize, i)
+	}
+	return offset
+}
+
+// atFileEOF reports whether loc is the last big block of a file of the
+// given size, i.e. whether a Store call for loc is the last one that will
+// ever deliver bytes for this file. Chunked mode needs this because a
+// chunk's rolling hash runs continuously across big-block boundaries, and
+// only really reaches EOF once the whole file has been seen.
+func atFileEOF(fileSize int64, loc BlockLocation) bool {
+	return loc.BlockIndex == ComputeNumBlocks(fileSize)-1
+}
+
+// chunkCarry tracks one file's progress through content-defined chunking
+// across however many Store calls it takes to see the whole file: bytes
+// buffered since the last chunk boundary (which may have started in a
+// previous call's data), and the index of the next chunk expected from
+// the signature. This is what lets a chunk span a big-block boundary
+// instead of always being cut there, so BlockLocation no longer dictates
+// where chunks start and end - only the byte stream does.
+//
+// ValidatingSink and HealingSink each keep one chunkCarry per file that
+// has an in-progress Store sequence, assuming (as the rest of this file
+// already does) that a file's big blocks are delivered to Store in
+// increasing BlockIndex order.
+type chunkCarry struct {
+	buf        []byte
+	chunkIndex int
+
+	// locs holds, in order, the BlockLocation of every Store call whose
+	// bytes are still sitting in buf (i.e. haven't yet been consumed by a
+	// completed chunk), each paired with the offset within buf where its
+	// contribution ends. HealingSink uses this to re-fetch and re-store
+	// every earlier block a corrupt chunk actually spans, not just the
+	// one right before it - MaxChunkSize is several times pwr.BlockSize,
+	// so a chunk can straddle more than one big-block boundary.
+	locs []locSpan
+}
+
+// locSpan records, within a chunkCarry's current buf, the byte offset
+// where one Store call's contribution ends and which BlockLocation that
+// call came from.
+type locSpan struct {
+	loc BlockLocation
+	end int
+}
@@ -0,0 +1,306 @@
+package blockpool
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/splitfunc"
+	"github.com/itchio/wharf/sync"
+	"github.com/itchio/wharf/tlc"
+)
+
+// A BlockSource supplies known-good bytes for a byte range of a file in
+// the signature's container, so a HealingSink can replace data that fails
+// validation instead of giving up on it. Implementations might issue an
+// HTTP range request, read from a local mirror, or pull from another
+// Pool — HealingSink doesn't care, as long as FetchBlock returns exactly
+// `length` bytes starting at `offset` in the file at fileIndex.
+type BlockSource interface {
+	FetchBlock(fileIndex int64, offset int64, length int64) ([]byte, error)
+}
+
+// A HealingSink wraps Sink the same way ValidatingSink does, but instead
+// of failing Store when a block (or, in chunked mode, a chunk) doesn't
+// match the signature, it fetches the correct bytes from Source and
+// writes those instead. This lets a caller use a partially-corrupt local
+// cache as a starting point for an install/update: only the blocks that
+// actually diverge from the signature get re-fetched, rather than the
+// whole container.
+type HealingSink struct {
+	Sink      Sink
+	Signature *SignatureInfo
+	Source    BlockSource
+	Consumer  *state.Consumer
+
+	// Chunker, when non-nil, switches Store into content-defined chunking
+	// mode, mirroring ValidatingSink.Chunker.
+	Chunker Chunker
+
+	// TotalHealed counts the bytes that were fetched from Source because
+	// they didn't match the signature.
+	TotalHealed int64
+
+	hashGroups map[BlockLocation][]sync.BlockHash
+	blockBuf   []byte
+	split      bufio.SplitFunc
+	sctx       sync.Context
+
+	chunkCarries map[int64]*chunkCarry
+}
+
+var _ Sink = (*HealingSink)(nil)
+
+func (hs *HealingSink) Store(loc BlockLocation, data []byte) error {
+	if hs.Chunker != nil {
+		return hs.storeChunked(loc, data)
+	}
+
+	if hs.hashGroups == nil {
+		err := hs.makeHashGroups()
+		if err != nil {
+			return errors.Wrap(err, 1)
+		}
+
+		hs.blockBuf = make([]byte, pwr.BlockSize)
+		hs.split = splitfunc.New(pwr.BlockSize)
+	}
+
+	hashGroup := hs.hashGroups[loc]
+	smallBlockSize := int64(pwr.BlockSize)
+
+	// see also ValidatingSink.Store
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(hs.blockBuf, 0)
+	s.Split(hs.split)
+
+	healed := make([]byte, 0, len(data))
+	hashIndex := 0
+
+	fileSize := hs.GetContainer().Files[loc.FileIndex].Size
+	blockStart := bigBlockOffset(fileSize, loc.BlockIndex)
+
+	for ; s.Scan(); hashIndex++ {
+		block := s.Bytes()
+		bh := hashGroup[hashIndex]
+
+		weakHash, strongHash := hs.sctx.HashBlock(block)
+		if bh.WeakHash != weakHash || !bytes.Equal(bh.StrongHash, strongHash) {
+			offset := blockStart + int64(hashIndex)*smallBlockSize
+			fixed, err := hs.heal(loc.FileIndex, offset, int64(len(block)))
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+			healed = append(healed, fixed...)
+		} else {
+			healed = append(healed, block...)
+		}
+	}
+
+	return hs.Sink.Store(loc, healed)
+}
+
+// storeChunked is the content-defined chunking equivalent of Store,
+// mirroring ValidatingSink.storeChunked: it buffers bytes across Store
+// calls in a chunkCarry so a chunk can span a big-block boundary instead
+// of always being cut there, then heals any chunk whose hash doesn't
+// match.
+//
+// A chunk that spans several Store calls has already had its earlier
+// share(s) written out via hs.Sink.Store(span.loc, ...) by the time the
+// call that completes it runs. If that chunk turns out corrupt, this
+// refetches every such span's entire block fresh from Source and
+// re-Stores it, rather than trying to patch the bytes already sent -
+// MaxChunkSize is several times pwr.BlockSize, so a chunk can span more
+// than one earlier call's worth of carry-over.
+func (hs *HealingSink) storeChunked(loc BlockLocation, data []byte) error {
+	chunkHashes := hs.Signature.chunkHashes[loc.FileIndex]
+	fileSize := hs.GetContainer().Files[loc.FileIndex].Size
+
+	if hs.chunkCarries == nil {
+		hs.chunkCarries = make(map[int64]*chunkCarry)
+	}
+	carry := hs.chunkCarries[loc.FileIndex]
+	if carry == nil {
+		carry = &chunkCarry{}
+		hs.chunkCarries[loc.FileIndex] = carry
+	}
+
+	carriedLen := len(carry.buf)
+	buf := append(carry.buf, data...)
+	atEOF := atFileEOF(fileSize, loc)
+
+	locs := append(carry.locs, locSpan{loc: loc, end: len(buf)})
+
+	healed := make([]byte, 0, len(data))
+	offset := 0
+
+	for {
+		length, found := hs.Chunker.Next(buf[offset:], atEOF)
+		if !found {
+			break
+		}
+
+		if carry.chunkIndex >= len(chunkHashes) {
+			err := errors.New("healer: got more chunks than signature has")
+			return errors.Wrap(err, 1)
+		}
+
+		ch := chunkHashes[carry.chunkIndex]
+
+		chunk := buf[offset : offset+length]
+		weakHash, strongHash := hs.sctx.HashBlock(chunk)
+		mismatched := ch.WeakHash != weakHash || !bytes.Equal(ch.StrongHash, strongHash)
+
+		// advance tracks how many buf bytes this chunk actually consumes.
+		// On a match that's whatever the chunker found, but on a mismatch
+		// it has to be ch.Length instead: corruption can shift where the
+		// rolling hash cuts, and trusting the locally re-discovered
+		// length here would desync offset (and carry.chunkIndex) from
+		// the signature for every chunk after this one.
+		advance := length
+		fixed := chunk
+		if mismatched {
+			advance = int(ch.Length)
+			if offset+advance > len(buf) {
+				if !atEOF {
+					// don't yet have enough bytes buffered to know the
+					// full extent of this chunk per the signature - wait
+					// for more
+					break
+				}
+				// no more data is coming; don't walk past what we have
+				advance = len(buf) - offset
+			}
+
+			var err error
+			fixed, err = hs.heal(loc.FileIndex, ch.Offset, ch.Length)
+			if err != nil {
+				return errors.Wrap(err, 1)
+			}
+
+			if offset < carriedLen {
+				// this chunk started before this call's own data, so one
+				// or more earlier Store calls already wrote their
+				// (corrupt) share of it - fix every block it spans, not
+				// just the one right before this call
+				for _, span := range locs {
+					if span.loc == loc || span.end <= offset {
+						continue
+					}
+
+					prevOffset := bigBlockOffset(fileSize, span.loc.BlockIndex)
+					prevSize := ComputeBlockSize(fileSize, span.loc.BlockIndex)
+					correctedPrev, err := hs.heal(loc.FileIndex, prevOffset, prevSize)
+					if err != nil {
+						return errors.Wrap(err, 1)
+					}
+					if err := hs.Sink.Store(span.loc, correctedPrev); err != nil {
+						return errors.Wrap(err, 1)
+					}
+				}
+			}
+		}
+
+		// clip fixed to this chunk's span within buf (matters on a
+		// mismatch, where fixed is ch.Length bytes and may disagree with
+		// the buffered length), then skip the portion belonging to
+		// earlier Store calls' already-(re)written bytes: only this
+		// call's own portion goes into healed for hs.Sink.Store(loc, ...)
+		// below
+		spanLen := advance
+		if offset+spanLen > len(buf) {
+			spanLen = len(buf) - offset
+		}
+		if spanLen > len(fixed) {
+			spanLen = len(fixed)
+		}
+		skip := carriedLen - offset
+		if skip < 0 {
+			skip = 0
+		}
+		if skip > spanLen {
+			skip = spanLen
+		}
+		healed = append(healed, fixed[skip:spanLen]...)
+
+		offset += advance
+		carry.chunkIndex++
+	}
+
+	// whatever's left doesn't complete a chunk yet: write it out
+	// optimistically as-is (this call still has to Store exactly
+	// len(data) bytes for loc), and if it turns out to belong to a
+	// corrupt chunk, the carriedLen branch above will correct it on a
+	// later call the same way it corrects any other carried-over prefix
+	tailStart := offset
+	if tailStart < carriedLen {
+		tailStart = carriedLen
+	}
+	healed = append(healed, buf[tailStart:]...)
+
+	carry.buf = append([]byte(nil), buf[offset:]...)
+
+	carry.locs = nil
+	for _, span := range locs {
+		if span.end > offset {
+			carry.locs = append(carry.locs, locSpan{loc: span.loc, end: span.end - offset})
+		}
+	}
+
+	return hs.Sink.Store(loc, healed)
+}
+
+// heal fetches the correct bytes for [offset, offset+length) of the file
+// at fileIndex from Source, reporting progress through Consumer and
+// tallying them into TotalHealed.
+func (hs *HealingSink) heal(fileIndex int64, offset int64, length int64) ([]byte, error) {
+	if hs.Consumer != nil {
+		f := hs.GetContainer().Files[fileIndex]
+		hs.Consumer.Debugf("healing %d bytes of %s at offset %d", length, f.Path, offset)
+	}
+
+	fixed, err := hs.Source.FetchBlock(fileIndex, offset, length)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	if int64(len(fixed)) != length {
+		f := hs.GetContainer().Files[fileIndex]
+		err := fmt.Errorf("healing %s at offset %d: BlockSource returned %d bytes, expected %d", f.Path, offset, len(fixed), length)
+		return nil, errors.Wrap(err, 1)
+	}
+
+	hs.TotalHealed += length
+	return fixed, nil
+}
+
+func (hs *HealingSink) GetContainer() *tlc.Container {
+	return hs.Sink.GetContainer()
+}
+
+func (hs *HealingSink) Clone() Sink {
+	return &HealingSink{
+		Sink:      hs.Sink,
+		Signature: hs.Signature,
+		Source:    hs.Source,
+		Consumer:  hs.Consumer,
+		Chunker:   hs.Chunker,
+	}
+}
+
+// makeHashGroups delegates to computeHashGroups, the same grouping logic
+// ValidatingSink.makeHashGroups uses, so both sinks agree on which hashes
+// apply to which BlockLocation.
+func (hs *HealingSink) makeHashGroups() error {
+	hashGroups, err := computeHashGroups(hs.GetContainer(), hs.Signature)
+	if err != nil {
+		return err
+	}
+
+	hs.hashGroups = hashGroups
+	return nil
+}
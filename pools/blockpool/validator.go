@@ -16,6 +16,37 @@ import (
 type SignatureInfo struct {
 	container *tlc.Container
 	hashes    []sync.BlockHash
+
+	// chunkHashes holds, per file index, the content-defined chunk hashes
+	// for that file. It's nil for a SignatureInfo produced with the
+	// historical fixed-block scheme, which uses hashes above instead.
+	// ValidatingSink and HealingSink pick the scheme from their Chunker
+	// field alone (nil means hashes), not from whether this is nil.
+	chunkHashes map[int64][]ChunkHash
+}
+
+// A ChunkHash is the content-defined equivalent of sync.BlockHash: since
+// chunks produced by a Chunker don't have a fixed size, a ChunkHash carries
+// its own Offset and Length within the file, rather than being addressed
+// purely by index.
+type ChunkHash struct {
+	Offset     int64
+	Length     int64
+	WeakHash   uint32
+	StrongHash []byte
+}
+
+// NewChunkedSignatureInfo builds a SignatureInfo for the content-defined
+// chunking scheme: unlike the fixed-block scheme, chunkHashes is keyed by
+// file index directly, since chunk boundaries (and therefore counts) vary
+// per file. Each file's entry should come from ComputeChunkHashes, run
+// over that file's bytes with the same Chunker the validating/healing
+// side will use, so both sides land on identical cuts.
+func NewChunkedSignatureInfo(container *tlc.Container, chunkHashes map[int64][]ChunkHash) *SignatureInfo {
+	return &SignatureInfo{
+		container:   container,
+		chunkHashes: chunkHashes,
+	}
 }
 
 // A ValidatingSink only stores blocks if they match the signature provided
@@ -24,15 +55,27 @@ type ValidatingSink struct {
 	Sink      Sink
 	Signature *SignatureInfo
 
+	// Chunker, when non-nil, switches Store into content-defined chunking
+	// mode: instead of slicing data into fixed pwr.BlockSize blocks, it is
+	// re-split with Chunker and each resulting chunk is checked against
+	// Signature.chunkHashes.
+	Chunker Chunker
+
 	hashGroups map[BlockLocation][]sync.BlockHash
 	blockBuf   []byte
 	split      bufio.SplitFunc
 	sctx       sync.Context
+
+	chunkCarries map[int64]*chunkCarry
 }
 
 var _ Sink = (*ValidatingSink)(nil)
 
 func (vs *ValidatingSink) Store(loc BlockLocation, data []byte) error {
+	if vs.Chunker != nil {
+		return vs.storeChunked(loc, data)
+	}
+
 	if vs.hashGroups == nil {
 		err := vs.makeHashGroups()
 		if err != nil {
@@ -70,6 +113,69 @@ func (vs *ValidatingSink) Store(loc BlockLocation, data []byte) error {
 	return vs.Sink.Store(loc, data)
 }
 
+// storeChunked validates data against Signature.chunkHashes by re-running
+// Chunker over it the same way the signature-producing side did: since
+// chunk boundaries are reproducible from the byte stream alone, both sides
+// must land on the exact same cuts.
+//
+// Store is called once per big block (see computeHashGroups), not once per
+// whole file, and a chunk's cut doesn't have to land on a big-block edge -
+// that's the whole point of content-defined chunking, so a chunk started
+// near the end of one block may only complete once the next block's data
+// arrives. chunkCarry buffers those not-yet-cut bytes across calls, keyed
+// by file, so validation stays correct regardless of how the file happens
+// to be sliced into big blocks.
+func (vs *ValidatingSink) storeChunked(loc BlockLocation, data []byte) error {
+	chunkHashes := vs.Signature.chunkHashes[loc.FileIndex]
+	fileSize := vs.GetContainer().Files[loc.FileIndex].Size
+
+	if vs.chunkCarries == nil {
+		vs.chunkCarries = make(map[int64]*chunkCarry)
+	}
+	carry := vs.chunkCarries[loc.FileIndex]
+	if carry == nil {
+		carry = &chunkCarry{}
+		vs.chunkCarries[loc.FileIndex] = carry
+	}
+
+	buf := append(carry.buf, data...)
+	atEOF := atFileEOF(fileSize, loc)
+
+	offset := 0
+	for {
+		length, found := vs.Chunker.Next(buf[offset:], atEOF)
+		if !found {
+			break
+		}
+
+		if carry.chunkIndex >= len(chunkHashes) {
+			err := fmt.Errorf("at %+v, got more chunks than signature has (expected %d)", loc, len(chunkHashes))
+			return errors.Wrap(err, 1)
+		}
+
+		chunk := buf[offset : offset+length]
+		weakHash, strongHash := vs.sctx.HashBlock(chunk)
+		ch := chunkHashes[carry.chunkIndex]
+
+		if ch.WeakHash != weakHash {
+			err := fmt.Errorf("at %+v chunk %d, expected weak hash %x, got %x", loc, carry.chunkIndex, ch.WeakHash, weakHash)
+			return errors.Wrap(err, 1)
+		}
+
+		if !bytes.Equal(ch.StrongHash, strongHash) {
+			err := fmt.Errorf("at %+v chunk %d, expected strong hash %x, got %x", loc, carry.chunkIndex, ch.StrongHash, strongHash)
+			return errors.Wrap(err, 1)
+		}
+
+		offset += length
+		carry.chunkIndex++
+	}
+
+	carry.buf = append([]byte(nil), buf[offset:]...)
+
+	return vs.Sink.Store(loc, data)
+}
+
 func (vs *ValidatingSink) GetContainer() *tlc.Container {
 	return vs.Sink.GetContainer()
 }
@@ -78,43 +184,16 @@ func (vs *ValidatingSink) Clone() Sink {
 	return &ValidatingSink{
 		Sink:      vs.Sink,
 		Signature: vs.Signature,
+		Chunker:   vs.Chunker,
 	}
 }
 
 func (vs *ValidatingSink) makeHashGroups() error {
-	smallBlockSize := int64(pwr.BlockSize)
-
-	pathToFileIndex := make(map[string]int64)
-	for fileIndex, f := range vs.GetContainer().Files {
-		pathToFileIndex[f.Path] = int64(fileIndex)
-	}
-
-	vs.hashGroups = make(map[BlockLocation][]sync.BlockHash)
-	hashIndex := int64(0)
-
-	for _, f := range vs.Signature.container.Files {
-		fileIndex := pathToFileIndex[f.Path]
-
-		if f.Size == 0 {
-			// empty files have a 0-length shortblock for historical reasons.
-			hashIndex++
-			continue
-		}
-
-		numBigBlocks := ComputeNumBlocks(f.Size)
-		for blockIndex := int64(0); blockIndex < numBigBlocks; blockIndex++ {
-			loc := BlockLocation{
-				FileIndex:  fileIndex,
-				BlockIndex: blockIndex,
-			}
-
-			blockSize := ComputeBlockSize(f.Size, blockIndex)
-			numSmallBlocks := (blockSize + smallBlockSize - 1) / smallBlockSize
-
-			vs.hashGroups[loc] = vs.Signature.hashes[hashIndex : hashIndex+numSmallBlocks]
-			hashIndex += numSmallBlocks
-		}
+	hashGroups, err := computeHashGroups(vs.GetContainer(), vs.Signature)
+	if err != nil {
+		return err
 	}
 
+	vs.hashGroups = hashGroups
 	return nil
 }
@@ -0,0 +1,340 @@
+package blockpool
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/itchio/wharf/tlc"
+)
+
+// pseudoRandomBytes returns deterministic, non-repeating filler data: the
+// rolling hash needs varied content to find chunk boundaries, which a
+// short repeating pattern won't reliably produce.
+func pseudoRandomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(42)).Read(buf)
+	return buf
+}
+
+// fakeSink is a minimal in-memory Sink, just enough to drive
+// ValidatingSink/HealingSink in tests without a real pool implementation.
+type fakeSink struct {
+	container *tlc.Container
+	stored    map[BlockLocation][]byte
+}
+
+func newFakeSink(container *tlc.Container) *fakeSink {
+	return &fakeSink{container: container, stored: map[BlockLocation][]byte{}}
+}
+
+func (fs *fakeSink) Store(loc BlockLocation, data []byte) error {
+	cp := append([]byte(nil), data...)
+	fs.stored[loc] = cp
+	return nil
+}
+
+func (fs *fakeSink) GetContainer() *tlc.Container {
+	return fs.container
+}
+
+func (fs *fakeSink) Clone() Sink {
+	return &fakeSink{container: fs.container, stored: map[BlockLocation][]byte{}}
+}
+
+var _ Sink = (*fakeSink)(nil)
+
+// splitIntoBlocks is a test helper: it chops data into big blocks the same
+// way a real Pool's Store calls would, using ComputeNumBlocks/
+// ComputeBlockSize directly rather than assuming a block size of our own -
+// those are what actually decide where big-block boundaries fall.
+func splitIntoBlocks(data []byte) [][]byte {
+	fileSize := int64(len(data))
+	numBlocks := ComputeNumBlocks(fileSize)
+
+	var blocks [][]byte
+	var offset int64
+	for i := int64(0); i < numBlocks; i++ {
+		size := ComputeBlockSize(fileSize, i)
+		blocks = append(blocks, data[offset:offset+size])
+		offset += size
+	}
+	if len(blocks) == 0 {
+		blocks = [][]byte{{}}
+	}
+	return blocks
+}
+
+// blockIndexAt returns the index of the big block that contains byte
+// offset, the same way computeHashGroups/bigBlockOffset would locate it.
+func blockIndexAt(fileSize int64, offset int64) int64 {
+	var start int64
+	for i := int64(0); ; i++ {
+		size := ComputeBlockSize(fileSize, i)
+		if offset < start+size {
+			return i
+		}
+		start += size
+	}
+}
+
+// TestValidatingSinkChunksSpanBigBlocks exercises storeChunked across
+// multiple Store calls whose boundaries land in the middle of a chunk, to
+// confirm a chunk carried over from a previous big block is still
+// validated correctly - the fix for chunk boundaries being forced onto
+// every big-block edge.
+func TestValidatingSinkChunksSpanBigBlocks(t *testing.T) {
+	data := pseudoRandomBytes(20 * AvgChunkSize) // enough to span several chunks
+
+	chunker := NewRollingHashChunker()
+	hashes, err := ComputeChunkHashes(bytes.NewReader(data), chunker)
+	if err != nil {
+		t.Fatalf("ComputeChunkHashes: %v", err)
+	}
+	if len(hashes) < 2 {
+		t.Fatalf("expected test data to produce more than one chunk, got %d", len(hashes))
+	}
+
+	container := &tlc.Container{Files: []*tlc.File{{Path: "f", Size: int64(len(data))}}}
+	sig := NewChunkedSignatureInfo(container, map[int64][]ChunkHash{0: hashes})
+
+	sink := newFakeSink(container)
+	vs := &ValidatingSink{Sink: sink, Signature: sig, Chunker: NewRollingHashChunker()}
+
+	blocks := splitIntoBlocks(data)
+
+	for i, block := range blocks {
+		loc := BlockLocation{FileIndex: 0, BlockIndex: int64(i)}
+		if err := vs.Store(loc, block); err != nil {
+			t.Fatalf("Store block %d: %v", i, err)
+		}
+	}
+}
+
+// fakeBlockSource serves bytes straight out of the known-good copy of the
+// file, as a real HTTP-range or mirror BlockSource would.
+type fakeBlockSource struct {
+	truth []byte
+}
+
+func (s *fakeBlockSource) FetchBlock(fileIndex int64, offset int64, length int64) ([]byte, error) {
+	return append([]byte(nil), s.truth[offset:offset+length]...), nil
+}
+
+var _ BlockSource = (*fakeBlockSource)(nil)
+
+// TestHealingSinkHealsChunkSpanningBigBlocks corrupts a byte that falls
+// inside a chunk straddling two big blocks, and checks that by the time
+// all blocks have been stored, both the block that started the chunk and
+// the block that completed it hold the correct bytes.
+func TestHealingSinkHealsChunkSpanningBigBlocks(t *testing.T) {
+	data := pseudoRandomBytes(20 * AvgChunkSize)
+
+	chunker := NewRollingHashChunker()
+	hashes, err := ComputeChunkHashes(bytes.NewReader(data), chunker)
+	if err != nil {
+		t.Fatalf("ComputeChunkHashes: %v", err)
+	}
+
+	fileSize := int64(len(data))
+
+	// find a chunk that straddles a block boundary, and corrupt a byte
+	// inside it in our local (corrupt) copy
+	var spanningChunk *ChunkHash
+	for i := range hashes {
+		startBlock := blockIndexAt(fileSize, hashes[i].Offset)
+		endBlock := blockIndexAt(fileSize, hashes[i].Offset+hashes[i].Length-1)
+		if endBlock > startBlock {
+			spanningChunk = &hashes[i]
+			break
+		}
+	}
+	if spanningChunk == nil {
+		t.Fatalf("expected at least one chunk to straddle a block boundary")
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[spanningChunk.Offset] ^= 0xff
+
+	blocks := splitIntoBlocks(data)
+	corruptBlocks := splitIntoBlocks(corrupt)
+
+	container := &tlc.Container{Files: []*tlc.File{{Path: "f", Size: int64(len(data))}}}
+	sig := NewChunkedSignatureInfo(container, map[int64][]ChunkHash{0: hashes})
+
+	sink := newFakeSink(container)
+	hs := &HealingSink{
+		Sink:      sink,
+		Signature: sig,
+		Source:    &fakeBlockSource{truth: data},
+		Chunker:   NewRollingHashChunker(),
+	}
+
+	for i, block := range corruptBlocks {
+		loc := BlockLocation{FileIndex: 0, BlockIndex: int64(i)}
+		if err := hs.Store(loc, block); err != nil {
+			t.Fatalf("Store block %d: %v", i, err)
+		}
+	}
+
+	if hs.TotalHealed == 0 {
+		t.Fatalf("expected TotalHealed to be non-zero after healing a corrupt chunk")
+	}
+
+	var rebuilt []byte
+	for i := range blocks {
+		rebuilt = append(rebuilt, sink.stored[BlockLocation{FileIndex: 0, BlockIndex: int64(i)}]...)
+	}
+
+	if !bytes.Equal(rebuilt, data) {
+		t.Fatalf("healed output does not match original data")
+	}
+}
+
+// TestHealingSinkHealsChunkSpanningManyBigBlocks is like
+// TestHealingSinkHealsChunkSpanningBigBlocks, but picks a chunk that
+// straddles three or more big blocks (MaxChunkSize is several times
+// pwr.BlockSize, so this does happen) and corrupts a byte in the middle of
+// it, far from the cut itself. Regression test for carry only tracking the
+// single immediately-preceding BlockLocation: every block the chunk spans,
+// not just the last one before it completed, needs to come back healed.
+func TestHealingSinkHealsChunkSpanningManyBigBlocks(t *testing.T) {
+	data := pseudoRandomBytes(200 * AvgChunkSize)
+
+	chunker := NewRollingHashChunker()
+	hashes, err := ComputeChunkHashes(bytes.NewReader(data), chunker)
+	if err != nil {
+		t.Fatalf("ComputeChunkHashes: %v", err)
+	}
+
+	fileSize := int64(len(data))
+
+	var spanningChunk *ChunkHash
+	for i := range hashes {
+		startBlock := blockIndexAt(fileSize, hashes[i].Offset)
+		endBlock := blockIndexAt(fileSize, hashes[i].Offset+hashes[i].Length-1)
+		if endBlock-startBlock >= 2 {
+			spanningChunk = &hashes[i]
+			break
+		}
+	}
+	if spanningChunk == nil {
+		t.Fatalf("expected at least one chunk to straddle 3+ big blocks")
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[spanningChunk.Offset+spanningChunk.Length/2] ^= 0xff
+
+	blocks := splitIntoBlocks(data)
+	corruptBlocks := splitIntoBlocks(corrupt)
+
+	container := &tlc.Container{Files: []*tlc.File{{Path: "f", Size: int64(len(data))}}}
+	sig := NewChunkedSignatureInfo(container, map[int64][]ChunkHash{0: hashes})
+
+	sink := newFakeSink(container)
+	hs := &HealingSink{
+		Sink:      sink,
+		Signature: sig,
+		Source:    &fakeBlockSource{truth: data},
+		Chunker:   NewRollingHashChunker(),
+	}
+
+	for i, block := range corruptBlocks {
+		loc := BlockLocation{FileIndex: 0, BlockIndex: int64(i)}
+		if err := hs.Store(loc, block); err != nil {
+			t.Fatalf("Store block %d: %v", i, err)
+		}
+	}
+
+	if hs.TotalHealed == 0 {
+		t.Fatalf("expected TotalHealed to be non-zero after healing a corrupt chunk")
+	}
+
+	var rebuilt []byte
+	for i := range blocks {
+		rebuilt = append(rebuilt, sink.stored[BlockLocation{FileIndex: 0, BlockIndex: int64(i)}]...)
+	}
+
+	if !bytes.Equal(rebuilt, data) {
+		t.Fatalf("healed output does not match original data")
+	}
+}
+
+// TestHealingSinkResyncsAfterChunkBoundaryShift corrupts a byte close
+// enough to a chunk's cut that the rolling hash, re-run over the corrupt
+// bytes, finds a different boundary than the signature recorded.
+// Regression test for storeChunked advancing by the locally re-discovered
+// length instead of the signature's ch.Length: with the bug, every chunk
+// after the corrupted one gets checked against the wrong chunkHashes
+// entry, which either cascades into spurious heals or an outright
+// "got more chunks than signature has" error.
+func TestHealingSinkResyncsAfterChunkBoundaryShift(t *testing.T) {
+	data := pseudoRandomBytes(50 * AvgChunkSize)
+
+	chunker := NewRollingHashChunker()
+	hashes, err := ComputeChunkHashes(bytes.NewReader(data), chunker)
+	if err != nil {
+		t.Fatalf("ComputeChunkHashes: %v", err)
+	}
+	if len(hashes) < 3 {
+		t.Fatalf("expected test data to produce several chunks, got %d", len(hashes))
+	}
+
+	// find a chunk (that isn't the last one) where flipping a byte near
+	// its end actually moves the rolling hash's cut, and corrupt it there
+	var corrupt []byte
+	var corruptedIndex int
+	for i := 0; i < len(hashes)-1; i++ {
+		ch := hashes[i]
+		for back := int64(1); back <= winSize && back <= ch.Length; back++ {
+			candidate := append([]byte(nil), data...)
+			pos := ch.Offset + ch.Length - back
+			candidate[pos] ^= 0xff
+
+			probe := NewRollingHashChunker()
+			length, found := probe.Next(candidate[ch.Offset:], false)
+			if found && int64(length) != ch.Length {
+				corrupt = candidate
+				corruptedIndex = i
+				break
+			}
+		}
+		if corrupt != nil {
+			break
+		}
+	}
+	if corrupt == nil {
+		t.Fatalf("couldn't find a byte flip that shifts a chunk boundary")
+	}
+
+	fileSize := int64(len(data))
+	blocks := splitIntoBlocks(data)
+	corruptBlocks := splitIntoBlocks(corrupt)
+
+	container := &tlc.Container{Files: []*tlc.File{{Path: "f", Size: fileSize}}}
+	sig := NewChunkedSignatureInfo(container, map[int64][]ChunkHash{0: hashes})
+
+	sink := newFakeSink(container)
+	hs := &HealingSink{
+		Sink:      sink,
+		Signature: sig,
+		Source:    &fakeBlockSource{truth: data},
+		Chunker:   NewRollingHashChunker(),
+	}
+
+	for i, block := range corruptBlocks {
+		loc := BlockLocation{FileIndex: 0, BlockIndex: int64(i)}
+		if err := hs.Store(loc, block); err != nil {
+			t.Fatalf("Store block %d (corrupted chunk was %d): %v", i, corruptedIndex, err)
+		}
+	}
+
+	var rebuilt []byte
+	for i := range blocks {
+		rebuilt = append(rebuilt, sink.stored[BlockLocation{FileIndex: 0, BlockIndex: int64(i)}]...)
+	}
+
+	if !bytes.Equal(rebuilt, data) {
+		t.Fatalf("healed output does not match original data after a boundary-shifting corruption")
+	}
+}